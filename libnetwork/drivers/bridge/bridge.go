@@ -0,0 +1,19 @@
+package bridge
+
+import (
+	"sync"
+
+	"github.com/docker/docker/libnetwork/portmapper"
+)
+
+// bridgeNetwork holds the runtime state the driver keeps for a single
+// bridge-backed network.
+type bridgeNetwork struct {
+	id           string
+	bridge       *bridgeInterface
+	config       *networkConfiguration
+	portMapper   *portmapper.PortMapper
+	portMapperV6 *portmapper.PortMapper
+	driver       *driver
+	sync.Mutex
+}
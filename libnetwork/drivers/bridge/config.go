@@ -0,0 +1,79 @@
+package bridge
+
+import "net"
+
+// DefaultBridgeName is the default name for the bridge interface managed
+// by the driver when unspecified by the caller.
+const DefaultBridgeName = "docker0"
+
+const (
+	// NATBackendIPTables programs outbound SNAT with an iptables nat-table
+	// rule (see setupOutboundSNAT). This is the default.
+	NATBackendIPTables = "iptables"
+	// NATBackendIPVS programs outbound SNAT through an IPVS FWMARK service
+	// plus a subnet-scoped MASQUERADE rule; addPortMappingIPVS publishes a
+	// port as an IPVS service. See setup_ipvs_linux.go.
+	NATBackendIPVS = "ipvs"
+)
+
+// configuration is the driver-wide configuration, populated once from the
+// generic options passed to (*driver).configure when the bridge driver is
+// registered.
+type configuration struct {
+	EnableIPForwarding  bool
+	EnableIPTables      bool
+	EnableIP6Tables     bool
+	EnableUserlandProxy bool
+	UserlandProxyPath   string
+	// NATBackend selects how outbound SNAT is programmed. One of
+	// NATBackendIPTables (default) or NATBackendIPVS.
+	NATBackend string
+	// FirewallBackend selects which tool programs the rules themselves,
+	// once NATBackend (and the rest of setupIP4Tables/setupIP6Tables) has
+	// decided what they should be: one of iptables.BackendIPTables,
+	// iptables.BackendNFTables or iptables.BackendAuto (default). It's
+	// threaded down from the daemon's --firewall-backend flag the same
+	// way every other field here is threaded down from dockerd config.
+	FirewallBackend string
+}
+
+// networkConfiguration holds the per-network configuration parsed out of
+// the generic and IPAM options passed to (*driver).CreateNetwork.
+type networkConfiguration struct {
+	ID                 string
+	BridgeName         string
+	EnableIPv6         bool
+	EnableIPMasquerade bool
+	EnableICC          bool
+	Mtu                int
+	AddressIPv4        *net.IPNet
+	AddressIPv6        *net.IPNet
+	DefaultBridge      bool
+	// HostIPv4, when set, is used as the SNAT source address for traffic
+	// leaving the bridge instead of the address of the outgoing interface.
+	HostIPv4 net.IP
+	// HostIPv6 is HostIPv4's IPv6 counterpart: when set, it's used as the
+	// SNAT source address instead of a plain MASQUERADE for IPv6 traffic
+	// leaving the bridge. It must be a global-unicast address assigned to
+	// an interface other than the bridge itself.
+	HostIPv6 net.IP
+	// SNATPerEndpoint marks a network as using per-endpoint SNAT rules,
+	// keyed on each container's own address, in addition to the subnet-wide
+	// rule. setupIP4Tables/setupIP6Tables do not read it, so setting it
+	// installs no rule by itself; addEndpointSNATRule and
+	// removeEndpointSNATRule install and remove such a rule.
+	SNATPerEndpoint bool
+	// MSSClamp, when non-empty, clamps the TCP MSS of packets forwarded
+	// through the bridge in the mangle table. The special value
+	// MSSClampAuto derives the clamp from the outgoing interface's path
+	// MTU; any other value must parse as a positive integer MSS.
+	MSSClamp string
+	// FirewallMark, when non-zero, is applied in the mangle table to
+	// packets leaving the bridge subnet, so operators can match on it for
+	// policy routing or QoS without having to re-derive the subnet.
+	FirewallMark uint32
+}
+
+// MSSClampAuto derives the TCP MSS clamp from the outgoing interface's path
+// MTU (iptables' --clamp-mss-to-pmtu), rather than an explicit value.
+const MSSClampAuto = "auto"
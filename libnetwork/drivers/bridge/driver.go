@@ -0,0 +1,55 @@
+package bridge
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/docker/libnetwork/netlabel"
+)
+
+// driver is the bridge driver's single instance, shared by every network
+// it manages.
+type driver struct {
+	config configuration
+	fw     FirewallDriver
+
+	networks map[string]*bridgeNetwork
+	sync.Mutex
+}
+
+func newDriver() *driver {
+	d := &driver{networks: map[string]*bridgeNetwork{}}
+	d.fw = newFirewallDriver(d)
+	return d
+}
+
+// configure parses the generic options handed to the driver at registration
+// time and, when iptables (or ip6tables) support is enabled, programs the
+// chains shared by every bridge network through the platform's
+// FirewallDriver.
+func (d *driver) configure(option map[string]interface{}) error {
+	var config configuration
+
+	if genericData, ok := option[netlabel.GenericData]; ok && genericData != nil {
+		switch opt := genericData.(type) {
+		case configuration:
+			config = opt
+		case *configuration:
+			config = *opt
+		default:
+			return fmt.Errorf("invalid configuration type (%T) passed to bridge driver", opt)
+		}
+	}
+
+	d.Lock()
+	d.config = config
+	d.Unlock()
+
+	if config.EnableIPTables || config.EnableIP6Tables {
+		if err := d.fw.SetupChains(config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
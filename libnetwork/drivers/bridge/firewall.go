@@ -0,0 +1,24 @@
+package bridge
+
+// FirewallDriver abstracts the host firewall operations the bridge driver
+// needs to publish ports, isolate networks from each other, and police
+// inter-container traffic, so that platforms without netfilter (FreeBSD's
+// pf, for instance) can provide an equivalent implementation instead of the
+// default iptablesFirewall.
+type FirewallDriver interface {
+	// SetupChains programs the chains/anchors shared by every bridge
+	// network, once, from the driver-wide configuration.
+	SetupChains(config configuration) error
+	// Setup programs every rule a bridge network needs: NAT, ICC,
+	// mangle and inter-network isolation, for whichever IP families the
+	// network has enabled.
+	Setup(config *networkConfiguration, br *bridgeInterface) error
+	// Teardown removes everything a previous Setup call installed for
+	// config.
+	Teardown(config *networkConfiguration, br *bridgeInterface) error
+	// AllowICC and DenyICC flip inter-container communication on a single
+	// bridge network without a full Setup/Teardown cycle, e.g. when a
+	// network's EnableICC setting is updated live.
+	AllowICC(config *networkConfiguration) error
+	DenyICC(config *networkConfiguration) error
+}
@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// Anchor names pf rules are loaded under, mirroring the nat/filter/
+// isolation split the Linux iptables backend uses, so a user inspecting
+// `pfctl -a docker/* -sr` sees the same shape as `iptables -S` would. Each
+// network gets its own sub-anchor, named after its bridge, under these --
+// loadAnchor replaces an anchor's entire rule set on every call, so sharing
+// one anchor across networks would wipe out every other network's rules
+// each time any one of them changed.
+const (
+	pfAnchorNAT       = "docker/nat"
+	pfAnchorFilter    = "docker/filter"
+	pfAnchorIsolation = "docker/isolation"
+)
+
+// pfDockerGroup is the pf(4) interface group every bridge-driver network's
+// bridge interface is expected to join (e.g. via `ifconfig <bridge> group
+// docker`), so the isolation anchor can block forwarding toward sibling
+// Docker bridges without having to enumerate their interface names here.
+const pfDockerGroup = "docker"
+
+// natAnchor, filterAnchor and isolationAnchor return the per-network
+// sub-anchor a bridge's nat/filter/isolation rules are loaded under.
+func natAnchor(bridgeName string) string       { return pfAnchorNAT + "/" + bridgeName }
+func filterAnchor(bridgeName string) string    { return pfAnchorFilter + "/" + bridgeName }
+func isolationAnchor(bridgeName string) string { return pfAnchorIsolation + "/" + bridgeName }
+
+// pfFirewall is the FreeBSD FirewallDriver, programming pf(4) anchors via
+// pfctl(8) instead of iptables.
+type pfFirewall struct {
+	driver *driver
+}
+
+func newFirewallDriver(d *driver) FirewallDriver {
+	return &pfFirewall{driver: d}
+}
+
+// SetupChains registers the empty docker/{nat,filter,isolation} anchors so
+// that they show up in `pfctl -a docker/* -sr` before any network has been
+// created, mirroring the way setupIPChains pre-creates the iptables DOCKER
+// chains.
+func (f *pfFirewall) SetupChains(config configuration) error {
+	for _, anchor := range []string{pfAnchorNAT, pfAnchorFilter, pfAnchorIsolation} {
+		if err := loadAnchor(anchor, ""); err != nil {
+			return fmt.Errorf("failed to register pf anchor %s: %w", anchor, err)
+		}
+	}
+	return nil
+}
+
+func (f *pfFirewall) Setup(config *networkConfiguration, br *bridgeInterface) error {
+	if config.EnableIPMasquerade {
+		nat := fmt.Sprintf("nat on egress from %s:network to any -> (egress)\n", config.BridgeName)
+		if err := loadAnchor(natAnchor(config.BridgeName), nat); err != nil {
+			return fmt.Errorf("failed to load pf NAT anchor: %w", err)
+		}
+	}
+
+	icc := "block in quick on " + config.BridgeName + " all\n"
+	if config.EnableICC {
+		icc = "pass in quick on " + config.BridgeName + " all\n"
+	}
+	if err := loadAnchor(filterAnchor(config.BridgeName), icc); err != nil {
+		return fmt.Errorf("failed to load pf filter anchor: %w", err)
+	}
+
+	// Block this bridge's traffic from being forwarded out through any
+	// other docker-group bridge, isolating sibling Docker networks from
+	// one another without touching this bridge's own egress path.
+	isolation := fmt.Sprintf("block out quick on ! %s group %s from %s:network to any\n", config.BridgeName, pfDockerGroup, config.BridgeName)
+	if err := loadAnchor(isolationAnchor(config.BridgeName), isolation); err != nil {
+		return fmt.Errorf("failed to load pf isolation anchor: %w", err)
+	}
+
+	return nil
+}
+
+func (f *pfFirewall) Teardown(config *networkConfiguration, br *bridgeInterface) error {
+	for _, anchor := range []string{natAnchor(config.BridgeName), filterAnchor(config.BridgeName), isolationAnchor(config.BridgeName)} {
+		if err := loadAnchor(anchor, ""); err != nil {
+			return fmt.Errorf("failed to flush pf anchor %s: %w", anchor, err)
+		}
+	}
+	return nil
+}
+
+func (f *pfFirewall) AllowICC(config *networkConfiguration) error {
+	config.EnableICC = true
+	return loadAnchor(filterAnchor(config.BridgeName), "pass in quick on "+config.BridgeName+" all\n")
+}
+
+func (f *pfFirewall) DenyICC(config *networkConfiguration) error {
+	config.EnableICC = false
+	return loadAnchor(filterAnchor(config.BridgeName), "block in quick on "+config.BridgeName+" all\n")
+}
+
+// loadAnchor replaces the rules under anchor with rules, via
+// `pfctl -a <anchor> -f -`. An empty rules string flushes the anchor.
+func loadAnchor(anchor, rules string) error {
+	cmd := exec.Command("pfctl", "-a", anchor, "-f", "-")
+	cmd.Stdin = bytes.NewReader([]byte(rules))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pfctl: %w: %s", err, stderr.String())
+	}
+	return nil
+}
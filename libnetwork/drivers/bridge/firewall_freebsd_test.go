@@ -0,0 +1,81 @@
+package bridge
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestSetupChainsPF is the FreeBSD analogue of TestSetupIPChains: it
+// asserts that pfFirewall.SetupChains and Setup install rules that show up
+// under the docker/* anchors, and that Teardown removes them again.
+func TestSetupChainsPF(t *testing.T) {
+	if _, err := exec.LookPath("pfctl"); err != nil {
+		t.Skip("pfctl(8) not installed")
+	}
+
+	d := &driver{config: configuration{EnableIPTables: true}}
+	fw := &pfFirewall{driver: d}
+	d.fw = fw
+
+	if err := fw.SetupChains(d.config); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &networkConfiguration{
+		BridgeName:         DefaultBridgeName,
+		AddressIPv4:        &net.IPNet{IP: net.ParseIP("192.168.42.1"), Mask: net.CIDRMask(16, 32)},
+		EnableIPMasquerade: true,
+	}
+	if err := fw.Setup(config, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second network's Setup must not clobber the first network's rules --
+	// each network gets its own sub-anchor, so both should show up at once.
+	otherConfig := &networkConfiguration{
+		BridgeName:         "docker1",
+		AddressIPv4:        &net.IPNet{IP: net.ParseIP("192.168.100.1"), Mask: net.CIDRMask(24, 32)},
+		EnableIPMasquerade: true,
+	}
+	if err := fw.Setup(otherConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("pfctl", "-a", "docker/*", "-sr").CombinedOutput()
+	if err != nil {
+		t.Fatalf("pfctl -a docker/* -sr: %v: %s", err, out)
+	}
+	if !strings.Contains(string(out), DefaultBridgeName) {
+		t.Fatalf("expected a rule referencing %s in the docker/* anchors, got:\n%s", DefaultBridgeName, out)
+	}
+	if !strings.Contains(string(out), otherConfig.BridgeName) {
+		t.Fatalf("expected %s's Setup not to clobber %s's rules, got:\n%s", otherConfig.BridgeName, DefaultBridgeName, out)
+	}
+
+	if err := fw.Teardown(otherConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("pfctl", "-a", "docker/*", "-sr").CombinedOutput()
+	if err != nil {
+		t.Fatalf("pfctl -a docker/* -sr: %v: %s", err, out)
+	}
+	if strings.Contains(string(out), otherConfig.BridgeName) {
+		t.Fatalf("expected no rules referencing %s after its Teardown, got:\n%s", otherConfig.BridgeName, out)
+	}
+	if !strings.Contains(string(out), DefaultBridgeName) {
+		t.Fatalf("expected %s's Teardown not to have affected %s's rules, got:\n%s", otherConfig.BridgeName, DefaultBridgeName, out)
+	}
+
+	if err := fw.Teardown(config, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err = exec.Command("pfctl", "-a", "docker/*", "-sr").CombinedOutput()
+	if err != nil {
+		t.Fatalf("pfctl -a docker/* -sr: %v: %s", err, out)
+	}
+	if strings.Contains(string(out), DefaultBridgeName) {
+		t.Fatalf("expected no rules referencing %s after Teardown, got:\n%s", DefaultBridgeName, out)
+	}
+}
@@ -0,0 +1,110 @@
+package bridge
+
+import "github.com/docker/docker/libnetwork/iptables"
+
+// iptablesFirewall is the default FirewallDriver, backed by the
+// setup_ip_tables_linux.go family of functions (iptables/ip6tables, or
+// nftables, depending on configuration.FirewallBackend).
+type iptablesFirewall struct {
+	driver *driver
+
+	natChain          *iptables.ChainInfo
+	filterChain       *iptables.ChainInfo
+	exposedChain      *iptables.ChainInfo
+	mangleChain       *iptables.ChainInfo
+	isolationChain1   *iptables.ChainInfo
+	isolationChain2   *iptables.ChainInfo
+	natChainV6        *iptables.ChainInfo
+	filterChainV6     *iptables.ChainInfo
+	exposedChainV6    *iptables.ChainInfo
+	mangleChainV6     *iptables.ChainInfo
+	isolationChain1V6 *iptables.ChainInfo
+	isolationChain2V6 *iptables.ChainInfo
+}
+
+func newFirewallDriver(d *driver) FirewallDriver {
+	return &iptablesFirewall{driver: d}
+}
+
+// SetupChains programs the nat/filter/exposed/mangle/isolation chains
+// shared by every bridge network, for IPv4 (always) and IPv6 (when
+// enabled).
+func (f *iptablesFirewall) SetupChains(config configuration) error {
+	if config.EnableIPTables {
+		natChain, filterChain, exposedChain, mangleChain, isolationChain1, isolationChain2, err := setupIPChains(config, iptables.IPv4)
+		if err != nil {
+			return err
+		}
+		f.natChain, f.filterChain, f.exposedChain, f.mangleChain, f.isolationChain1, f.isolationChain2 = natChain, filterChain, exposedChain, mangleChain, isolationChain1, isolationChain2
+	}
+
+	if config.EnableIP6Tables {
+		natChainV6, filterChainV6, exposedChainV6, mangleChainV6, isolationChain1V6, isolationChain2V6, err := setupIPChains(config, iptables.IPv6)
+		if err != nil {
+			return err
+		}
+		f.natChainV6, f.filterChainV6, f.exposedChainV6, f.mangleChainV6, f.isolationChain1V6, f.isolationChain2V6 = natChainV6, filterChainV6, exposedChainV6, mangleChainV6, isolationChain1V6, isolationChain2V6
+	}
+
+	return nil
+}
+
+// Setup programs IPv4 rules, and IPv6 rules when the network has IPv6
+// enabled. It adds no inter-network isolation rules: the
+// DOCKER-ISOLATION-STAGE-1/2 chains SetupChains creates stay empty.
+func (f *iptablesFirewall) Setup(config *networkConfiguration, br *bridgeInterface) error {
+	nw := &bridgeNetwork{config: config, driver: f.driver}
+
+	if err := nw.setupIP4Tables(config, br); err != nil {
+		return err
+	}
+	if config.EnableIPv6 {
+		return nw.setupIP6Tables(config, br)
+	}
+	return nil
+}
+
+// Teardown removes the ICC, non-ICC, outbound NAT (iptables or IPVS,
+// depending on configuration.NATBackend) and mangle-table rules Setup
+// installed; the shared chains themselves are left in place.
+func (f *iptablesFirewall) Teardown(config *networkConfiguration, br *bridgeInterface) error {
+	nw := &bridgeNetwork{config: config, driver: f.driver}
+
+	if err := nw.teardownIP4Tables(config); err != nil {
+		return err
+	}
+	if config.EnableIPv6 {
+		return nw.teardownIP6Tables(config)
+	}
+	return nil
+}
+
+// AllowICC and DenyICC replace the network's IPv4 ICC rule with the one for
+// the new setting; an IPv6 ICC rule, if any, is left unchanged.
+func (f *iptablesFirewall) AllowICC(config *networkConfiguration) error {
+	if err := teardownICCRule(iptables.IPv4, config); err != nil {
+		return err
+	}
+	config.EnableICC = true
+	return setupICCRule(iptables.IPv4, config)
+}
+
+func (f *iptablesFirewall) DenyICC(config *networkConfiguration) error {
+	if err := teardownICCRule(iptables.IPv4, config); err != nil {
+		return err
+	}
+	config.EnableICC = false
+	return setupICCRule(iptables.IPv4, config)
+}
+
+// setupNonICCRuleTeardown removes the unconditional outgoing-ACCEPT rule
+// setupNonICCRule installs.
+func setupNonICCRuleTeardown(version iptables.IPVersion, config *networkConfiguration) error {
+	nonICCRule := iptRule{
+		ipv:   version,
+		table: iptables.Filter,
+		chain: "FORWARD",
+		args:  []string{"-i", config.BridgeName, "!", "-o", config.BridgeName, "-j", "ACCEPT"},
+	}
+	return programChainRule(nonICCRule, "Non-ICC outgoing", false)
+}
@@ -0,0 +1,58 @@
+package bridge
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// bridgeInterface wraps the netlink handle and link used to configure the
+// network interface backing a bridge network.
+type bridgeInterface struct {
+	nlh  *netlink.Handle
+	Link netlink.Link
+}
+
+// setupDevice creates the bridge interface if it doesn't already exist and
+// brings it up.
+func setupDevice(config *networkConfiguration, i *bridgeInterface) error {
+	la := netlink.NewLinkAttrs()
+	la.Name = config.BridgeName
+	if config.Mtu != 0 {
+		la.MTU = config.Mtu
+	}
+
+	if err := i.nlh.LinkAdd(&netlink.Bridge{LinkAttrs: la}); err != nil {
+		return fmt.Errorf("failed to create bridge %s via netlink: %v", config.BridgeName, err)
+	}
+
+	link, err := i.nlh.LinkByName(config.BridgeName)
+	if err != nil {
+		return fmt.Errorf("failed to find bridge %s: %v", config.BridgeName, err)
+	}
+	i.Link = link
+
+	return i.nlh.LinkSetUp(link)
+}
+
+// setupBridgeIPv4 assigns the network's IPv4 address to the bridge.
+func setupBridgeIPv4(config *networkConfiguration, i *bridgeInterface) error {
+	if config.AddressIPv4 == nil {
+		return nil
+	}
+	if err := i.nlh.AddrAdd(i.Link, &netlink.Addr{IPNet: config.AddressIPv4}); err != nil {
+		return fmt.Errorf("failed to add IPv4 address %s to bridge %s: %v", config.AddressIPv4, config.BridgeName, err)
+	}
+	return nil
+}
+
+// setupBridgeIPv6 assigns the network's IPv6 address to the bridge.
+func setupBridgeIPv6(config *networkConfiguration, i *bridgeInterface) error {
+	if config.AddressIPv6 == nil {
+		return nil
+	}
+	if err := i.nlh.AddrAdd(i.Link, &netlink.Addr{IPNet: config.AddressIPv6}); err != nil {
+		return fmt.Errorf("failed to add IPv6 address %s to bridge %s: %v", config.AddressIPv6, config.BridgeName, err)
+	}
+	return nil
+}
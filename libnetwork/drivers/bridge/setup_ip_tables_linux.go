@@ -0,0 +1,561 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/docker/docker/libnetwork/iptables"
+)
+
+// DockerChain is the name of the chain the driver hangs its own nat and
+// filter rules off of, so that they're easy to tell apart from -- and don't
+// interleave with -- rules a user or another piece of software may have
+// added to the built-in chains.
+const DockerChain = "DOCKER"
+
+const (
+	isolationChain1 = "DOCKER-ISOLATION-STAGE-1"
+	isolationChain2 = "DOCKER-ISOLATION-STAGE-2"
+	// exposedChainName holds only the per-container published-port ACCEPT
+	// rules, so FORWARD stays uncluttered and every one of them can be
+	// dropped in a single flush on daemon shutdown.
+	exposedChainName = "DOCKER-EXPOSED"
+	// userChain is jumped to before any other Docker-managed chain, so a
+	// user's rules in it take precedence over the rules in those chains
+	// without having to reorder rules around them. The per-network ICC and
+	// outgoing rules that setupIP4Tables/setupIP6Tables insert into FORWARD
+	// itself are evaluated before this jump.
+	userChain = "DOCKER-USER"
+)
+
+// backends holds the FirewallBackend picked (per IP version) by the most
+// recent setupIPChains call, so that programChainRule -- which only has a
+// rule and no configuration to hand -- keeps programming the same backend
+// the chains it's targeting were created with.
+var (
+	backendsMu sync.RWMutex
+	backends   = map[iptables.IPVersion]iptables.FirewallBackend{}
+)
+
+// getBackend returns the FirewallBackend registered for version, falling
+// back to the plain iptables backend for callers (existing tests among
+// them) that program rules without going through setupIPChains first.
+func getBackend(version iptables.IPVersion) iptables.FirewallBackend {
+	backendsMu.RLock()
+	b, ok := backends[version]
+	backendsMu.RUnlock()
+	if ok {
+		return b
+	}
+	be, _ := iptables.SelectFirewallBackend(iptables.BackendIPTables, version)
+	return be
+}
+
+// iptRule is a single iptables rule, fully qualified with the table and
+// chain it belongs to, so that it can be added, removed, and checked for
+// existence independently of any other rule.
+type iptRule struct {
+	ipv   iptables.IPVersion
+	table iptables.Table
+	chain string
+	args  []string
+}
+
+// Exists reports whether the rule is currently present in its table/chain.
+func (r iptRule) Exists() bool {
+	return getBackend(r.ipv).Exists(r.table, r.chain, r.args...)
+}
+
+// programChainRule adds or removes a single rule, through whichever
+// FirewallBackend is active for the rule's IP version, wrapping any
+// failure with a description of the rule that couldn't be programmed.
+func programChainRule(rule iptRule, ruleDescr string, insert bool) error {
+	backend := getBackend(rule.ipv)
+	var err error
+	if insert {
+		err = backend.AddRule(rule.table, rule.chain, rule.args...)
+	} else {
+		err = backend.RemoveRule(rule.table, rule.chain, rule.args...)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to program %s rule: %w", ruleDescr, err)
+	}
+	return nil
+}
+
+// setupIPChains selects the FirewallBackend named by config.FirewallBackend
+// (falling back to auto-detection) and uses it to program the nat, filter,
+// exposed-port and isolation chains shared by every bridge network, for the
+// given IP version. It also wires FORWARD to jump, unconditionally and in
+// order, through DOCKER-USER (left for the user to fill in), DOCKER-EXPOSED
+// (per-container published-port ACCEPT rules) and DOCKER-ISOLATION-STAGE-1.
+// The rules setupIP4Tables/setupIP6Tables later add to FORWARD directly are
+// inserted at its head, so they are evaluated ahead of these jumps.
+func setupIPChains(config configuration, version iptables.IPVersion) (natChain, filterChain, exposedChain, mangleChain, isolationChain1Info, isolationChain2Info *iptables.ChainInfo, err error) {
+	backend, err := iptables.SelectFirewallBackend(iptables.BackendName(config.FirewallBackend), version)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, err
+	}
+	backendsMu.Lock()
+	backends[version] = backend
+	backendsMu.Unlock()
+
+	natChain, err = backend.NewChain(DockerChain, iptables.Nat)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create NAT chain %s: %v", DockerChain, err)
+	}
+	defer func() {
+		if err != nil {
+			if errF := backend.RemoveExistingChain(DockerChain, iptables.Nat); errF != nil {
+				err = fmt.Errorf("%v, error during cleanup: %v", err, errF)
+			}
+		}
+	}()
+
+	filterChain, err = backend.NewChain(DockerChain, iptables.Filter)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create FILTER chain %s: %v", DockerChain, err)
+	}
+	defer func() {
+		if err != nil {
+			if errF := backend.RemoveExistingChain(DockerChain, iptables.Filter); errF != nil {
+				err = fmt.Errorf("%v, error during cleanup: %v", err, errF)
+			}
+		}
+	}()
+
+	if _, err = backend.NewChain(userChain, iptables.Filter); err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create %s chain: %v", userChain, err)
+	}
+
+	exposedChain, err = backend.NewChain(exposedChainName, iptables.Filter)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create %s chain: %v", exposedChainName, err)
+	}
+	defer func() {
+		if err != nil {
+			if errF := backend.RemoveExistingChain(exposedChainName, iptables.Filter); errF != nil {
+				err = fmt.Errorf("%v, error during cleanup: %v", err, errF)
+			}
+		}
+	}()
+
+	mangleChain, err = backend.NewChain(DockerChain, iptables.Mangle)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create MANGLE chain %s: %v", DockerChain, err)
+	}
+	defer func() {
+		if err != nil {
+			if errF := backend.RemoveExistingChain(DockerChain, iptables.Mangle); errF != nil {
+				err = fmt.Errorf("%v, error during cleanup: %v", err, errF)
+			}
+		}
+	}()
+
+	isolationChain1Info, err = backend.NewChain(isolationChain1, iptables.Filter)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create %s chain: %v", isolationChain1, err)
+	}
+	defer func() {
+		if err != nil {
+			if errF := backend.RemoveExistingChain(isolationChain1, iptables.Filter); errF != nil {
+				err = fmt.Errorf("%v, error during cleanup: %v", err, errF)
+			}
+		}
+	}()
+
+	isolationChain2Info, err = backend.NewChain(isolationChain2, iptables.Filter)
+	if err != nil {
+		return nil, nil, nil, nil, nil, nil, fmt.Errorf("failed to create %s chain: %v", isolationChain2, err)
+	}
+
+	// Order matters: each insert lands at the top of FORWARD, so the last
+	// one inserted ends up evaluated first.
+	for _, jump := range []string{isolationChain1, exposedChainName, userChain} {
+		rule := iptRule{ipv: version, table: iptables.Filter, chain: "FORWARD", args: []string{"-j", jump}}
+		if err = programChainRule(rule, fmt.Sprintf("FORWARD -> %s", jump), true); err != nil {
+			return nil, nil, nil, nil, nil, nil, err
+		}
+	}
+
+	mangleJump := iptRule{ipv: version, table: iptables.Mangle, chain: "FORWARD", args: []string{"-j", DockerChain}}
+	if err = programChainRule(mangleJump, "mangle FORWARD -> DOCKER", true); err != nil {
+		return nil, nil, nil, nil, nil, nil, err
+	}
+
+	return natChain, filterChain, exposedChain, mangleChain, isolationChain1Info, isolationChain2Info, nil
+}
+
+// setupIP4Tables programs the IPv4 ICC and outgoing filter rules, outbound
+// masquerading, and the mangle-table MSSClamp/FirewallMark rules for the
+// network's bridge. Outbound masquerading goes through the NAT backend
+// selected on the driver's configuration: the default NATBackendIPTables
+// installs a nat-table rule (see setupOutboundSNAT), while NATBackendIPVS
+// uses an IPVS FWMARK service (see setup_ipvs_linux.go); with
+// NATBackendIPVS the mangle-table rules are not installed. No
+// published-port DNAT or inter-network isolation rules are programmed here.
+func (n *bridgeNetwork) setupIP4Tables(config *networkConfiguration, i *bridgeInterface) error {
+	d := n.driver
+	d.Lock()
+	driverConfig := d.config
+	d.Unlock()
+
+	if !driverConfig.EnableIPTables {
+		return nil
+	}
+
+	if err := setupNonICCRule(iptables.IPv4, config); err != nil {
+		return err
+	}
+
+	if err := setupICCRule(iptables.IPv4, config); err != nil {
+		return err
+	}
+
+	if driverConfig.NATBackend == NATBackendIPVS {
+		if config.EnableIPMasquerade {
+			if err := n.setupIPVSMasquerade(config); err != nil {
+				return fmt.Errorf("failed to set up IPVS masquerading: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if config.EnableIPMasquerade {
+		if err := setupOutboundSNAT(iptables.IPv4, config, config.AddressIPv4.String(), config.HostIPv4); err != nil {
+			return err
+		}
+	}
+
+	if err := setupMangleRules(iptables.IPv4, config); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// setupIP6Tables programs the IPv6 equivalent of setupIP4Tables.
+func (n *bridgeNetwork) setupIP6Tables(config *networkConfiguration, i *bridgeInterface) error {
+	d := n.driver
+	d.Lock()
+	driverConfig := d.config
+	d.Unlock()
+
+	if !driverConfig.EnableIP6Tables {
+		return nil
+	}
+
+	if err := setupNonICCRule(iptables.IPv6, config); err != nil {
+		return err
+	}
+
+	if err := setupICCRule(iptables.IPv6, config); err != nil {
+		return err
+	}
+
+	if driverConfig.NATBackend == NATBackendIPVS {
+		if config.EnableIPMasquerade {
+			if err := n.setupIPVSMasquerade(config); err != nil {
+				return fmt.Errorf("failed to set up IPVS masquerading: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if config.EnableIPMasquerade && config.AddressIPv6 != nil {
+		if config.HostIPv6 != nil {
+			if err := validateHostIP(config.HostIPv6, config.BridgeName); err != nil {
+				return fmt.Errorf("invalid HostIPv6: %w", err)
+			}
+		}
+		if err := setupOutboundSNAT(iptables.IPv6, config, config.AddressIPv6.String(), config.HostIPv6); err != nil {
+			return err
+		}
+	}
+
+	if err := setupMangleRules(iptables.IPv6, config); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// teardownIP4Tables is the teardown counterpart of setupIP4Tables, removing
+// every rule it can install for the network's bridge.
+func (n *bridgeNetwork) teardownIP4Tables(config *networkConfiguration) error {
+	d := n.driver
+	d.Lock()
+	driverConfig := d.config
+	d.Unlock()
+
+	if !driverConfig.EnableIPTables {
+		return nil
+	}
+
+	if err := setupNonICCRuleTeardown(iptables.IPv4, config); err != nil {
+		return err
+	}
+
+	if err := teardownICCRule(iptables.IPv4, config); err != nil {
+		return err
+	}
+
+	if driverConfig.NATBackend == NATBackendIPVS {
+		if config.EnableIPMasquerade {
+			if err := n.teardownIPVSMasquerade(config); err != nil {
+				return fmt.Errorf("failed to tear down IPVS masquerading: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if config.EnableIPMasquerade {
+		if err := teardownOutboundSNAT(iptables.IPv4, config, config.AddressIPv4.String(), config.HostIPv4); err != nil {
+			return err
+		}
+	}
+
+	return teardownMangleRules(iptables.IPv4, config)
+}
+
+// teardownIP6Tables is the IPv6 equivalent of teardownIP4Tables.
+func (n *bridgeNetwork) teardownIP6Tables(config *networkConfiguration) error {
+	d := n.driver
+	d.Lock()
+	driverConfig := d.config
+	d.Unlock()
+
+	if !driverConfig.EnableIP6Tables {
+		return nil
+	}
+
+	if err := setupNonICCRuleTeardown(iptables.IPv6, config); err != nil {
+		return err
+	}
+
+	if err := teardownICCRule(iptables.IPv6, config); err != nil {
+		return err
+	}
+
+	if driverConfig.NATBackend == NATBackendIPVS {
+		if config.EnableIPMasquerade {
+			if err := n.teardownIPVSMasquerade(config); err != nil {
+				return fmt.Errorf("failed to tear down IPVS masquerading: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if config.EnableIPMasquerade && config.AddressIPv6 != nil {
+		if err := teardownOutboundSNAT(iptables.IPv6, config, config.AddressIPv6.String(), config.HostIPv6); err != nil {
+			return err
+		}
+	}
+
+	return teardownMangleRules(iptables.IPv6, config)
+}
+
+// setupICCRule allows or denies inter-container communication on the given
+// bridge, depending on config.EnableICC.
+func setupICCRule(version iptables.IPVersion, config *networkConfiguration) error {
+	return programICCRule(version, config, true)
+}
+
+// teardownICCRule removes the rule setupICCRule installs.
+func teardownICCRule(version iptables.IPVersion, config *networkConfiguration) error {
+	return programICCRule(version, config, false)
+}
+
+func programICCRule(version iptables.IPVersion, config *networkConfiguration, insert bool) error {
+	var action iptables.Action = iptables.Drop
+	if config.EnableICC {
+		action = iptables.Accept
+	}
+	iccRule := iptRule{
+		ipv:   version,
+		table: iptables.Filter,
+		chain: "FORWARD",
+		args:  []string{"-i", config.BridgeName, "-o", config.BridgeName, "-j", action.String()},
+	}
+	return programChainRule(iccRule, "ICC", insert)
+}
+
+// setupNonICCRule always allows outgoing traffic from the bridge to a
+// different interface; only traffic between two endpoints on the same
+// bridge is subject to the ICC policy above.
+func setupNonICCRule(version iptables.IPVersion, config *networkConfiguration) error {
+	nonICCRule := iptRule{
+		ipv:   version,
+		table: iptables.Filter,
+		chain: "FORWARD",
+		args:  []string{"-i", config.BridgeName, "!", "-o", config.BridgeName, "-j", "ACCEPT"},
+	}
+	return programChainRule(nonICCRule, "Non-ICC outgoing", true)
+}
+
+// setupOutboundSNAT programs the nat-table POSTROUTING rule that lets
+// traffic from subnetCIDR reach the outside world: a plain MASQUERADE by
+// default, or -- when hostIP is set -- a fixed SNAT to hostIP, so the
+// bridge's outbound traffic always leaves with the same source address
+// regardless of which interface it exits through. This subnet-wide rule is
+// always installed, even when config.SNATPerEndpoint is set: this driver has
+// no endpoint join/leave hook to call addEndpointSNATRule/
+// removeEndpointSNATRule from, so until that wiring exists, suppressing the
+// subnet-wide rule would leave a SNATPerEndpoint network with no outbound
+// NAT at all.
+func setupOutboundSNAT(version iptables.IPVersion, config *networkConfiguration, subnetCIDR string, hostIP net.IP) error {
+	return programOutboundSNAT(version, config, subnetCIDR, hostIP, true)
+}
+
+// teardownOutboundSNAT removes the rule setupOutboundSNAT installs.
+func teardownOutboundSNAT(version iptables.IPVersion, config *networkConfiguration, subnetCIDR string, hostIP net.IP) error {
+	return programOutboundSNAT(version, config, subnetCIDR, hostIP, false)
+}
+
+func programOutboundSNAT(version iptables.IPVersion, config *networkConfiguration, subnetCIDR string, hostIP net.IP, insert bool) error {
+	args := []string{"-s", subnetCIDR, "!", "-o", config.BridgeName, "-j", "MASQUERADE"}
+	if hostIP != nil {
+		args = []string{"-s", subnetCIDR, "!", "-o", config.BridgeName, "-j", "SNAT", "--to-source", hostIP.String()}
+	}
+	rule := iptRule{ipv: version, table: iptables.Nat, chain: "POSTROUTING", args: args}
+	return programChainRule(rule, "PostRouting/Outbound NAT", insert)
+}
+
+// addEndpointSNATRule installs a per-endpoint SNAT rule keyed on
+// containerIP, alongside the subnet-wide rule setupOutboundSNAT installs,
+// so that networks sharing an uplink can still present a distinct source
+// address per container. It is not yet called from this driver's own
+// network/endpoint lifecycle -- callers wanting per-endpoint SNAT today
+// must invoke it themselves as each endpoint joins.
+func addEndpointSNATRule(version iptables.IPVersion, config *networkConfiguration, containerIP, hostIP net.IP) error {
+	rule := iptRule{
+		ipv:   version,
+		table: iptables.Nat,
+		chain: "POSTROUTING",
+		args:  []string{"-s", containerIP.String(), "!", "-o", config.BridgeName, "-j", "SNAT", "--to-source", hostIP.String()},
+	}
+	return programChainRule(rule, "PostRouting/Per-endpoint SNAT", true)
+}
+
+// removeEndpointSNATRule is the inverse of addEndpointSNATRule.
+func removeEndpointSNATRule(version iptables.IPVersion, config *networkConfiguration, containerIP, hostIP net.IP) error {
+	rule := iptRule{
+		ipv:   version,
+		table: iptables.Nat,
+		chain: "POSTROUTING",
+		args:  []string{"-s", containerIP.String(), "!", "-o", config.BridgeName, "-j", "SNAT", "--to-source", hostIP.String()},
+	}
+	return programChainRule(rule, "PostRouting/Per-endpoint SNAT", false)
+}
+
+// validateHostIP checks that hostIP is a global-unicast address assigned to
+// some interface other than bridgeName, so that HostIPv6 can't silently
+// SNAT to an address the host doesn't actually own.
+func validateHostIP(hostIP net.IP, bridgeName string) error {
+	if !hostIP.IsGlobalUnicast() {
+		return fmt.Errorf("%s is not a global unicast address", hostIP)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Name == bridgeName {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.Equal(hostIP) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s is not assigned to any interface other than %s", hostIP, bridgeName)
+}
+
+// setupMangleRules programs the mangle-table rules driven by
+// networkConfiguration.MSSClamp and FirewallMark, into the DOCKER chain of
+// the mangle table.
+func setupMangleRules(version iptables.IPVersion, config *networkConfiguration) error {
+	return programMangleRules(version, config, true)
+}
+
+// teardownMangleRules removes the rules setupMangleRules installs.
+func teardownMangleRules(version iptables.IPVersion, config *networkConfiguration) error {
+	return programMangleRules(version, config, false)
+}
+
+func programMangleRules(version iptables.IPVersion, config *networkConfiguration, insert bool) error {
+	if config.MSSClamp != "" {
+		args := []string{"-o", config.BridgeName, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS"}
+		if config.MSSClamp == MSSClampAuto {
+			args = append(args, "--clamp-mss-to-pmtu")
+		} else {
+			mss, err := strconv.Atoi(config.MSSClamp)
+			if err != nil || mss <= 0 {
+				return fmt.Errorf("invalid MSSClamp value %q: must be %q or a positive integer", config.MSSClamp, MSSClampAuto)
+			}
+			args = append(args, "--set-mss", strconv.Itoa(mss))
+		}
+		mssRule := iptRule{ipv: version, table: iptables.Mangle, chain: DockerChain, args: args}
+		if err := programChainRule(mssRule, "MSS clamp", insert); err != nil {
+			return err
+		}
+	}
+
+	if config.FirewallMark != 0 {
+		addr := config.AddressIPv4
+		if version == iptables.IPv6 {
+			addr = config.AddressIPv6
+		}
+		if addr == nil {
+			return nil
+		}
+		markRule := iptRule{
+			ipv:   version,
+			table: iptables.Mangle,
+			chain: DockerChain,
+			args:  []string{"-s", addr.String(), "!", "-o", config.BridgeName, "-j", "MARK", "--set-mark", strconv.FormatUint(uint64(config.FirewallMark), 10)},
+		}
+		if err := programChainRule(markRule, "FirewallMark", insert); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addExposedPortRule publishes a single container port by inserting an
+// ACCEPT rule into DOCKER-EXPOSED, rather than prepending it to FORWARD.
+// This is the primitive a port-publishing caller (bridgeNetwork's
+// portMapper/portMapperV6) programs each published port through; that
+// caller isn't part of this driver yet, so nothing in this tree invokes
+// addExposedPortRule/removeExposedPortRule outside of tests.
+func addExposedPortRule(proto string, containerIP net.IP, containerPort int) error {
+	rule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Filter,
+		chain: exposedChainName,
+		args:  []string{"-d", containerIP.String(), "-p", proto, "--dport", strconv.Itoa(containerPort), "-j", "ACCEPT"},
+	}
+	return programChainRule(rule, "Exposed port ACCEPT", true)
+}
+
+// removeExposedPortRule is the inverse of addExposedPortRule, called when a
+// published port is torn down.
+func removeExposedPortRule(proto string, containerIP net.IP, containerPort int) error {
+	rule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Filter,
+		chain: exposedChainName,
+		args:  []string{"-d", containerIP.String(), "-p", proto, "--dport", strconv.Itoa(containerPort), "-j", "ACCEPT"},
+	}
+	return programChainRule(rule, "Exposed port ACCEPT", false)
+}
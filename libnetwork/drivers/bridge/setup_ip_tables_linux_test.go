@@ -2,6 +2,7 @@ package bridge
 
 import (
 	"net"
+	"os/exec"
 	"testing"
 
 	"github.com/docker/docker/internal/testutils/netnsutils"
@@ -15,67 +16,100 @@ const (
 	iptablesTestBridgeIP = "192.168.42.1"
 )
 
-func TestProgramIPTable(t *testing.T) {
-	// Create a test bridge with a basic bridge configuration (name + IPv4).
-	defer netnsutils.SetupTestOSContext(t)()
+// testFirewallBackends is run by every test in this file that exercises
+// rule/chain programming, so each gets coverage against both backends.
+// The nftables entry is skipped by the caller when nft(8) isn't installed.
+var testFirewallBackends = []iptables.BackendName{iptables.BackendIPTables, iptables.BackendNFTables}
 
-	nh, err := netlink.NewHandle()
-	if err != nil {
-		t.Fatal(err)
+func skipIfBackendUnavailable(t *testing.T, backend iptables.BackendName) {
+	t.Helper()
+	if backend == iptables.BackendNFTables {
+		if _, err := exec.LookPath("nft"); err != nil {
+			t.Skip("nft(8) not installed")
+		}
 	}
+}
 
-	createTestBridge(getBasicTestConfig(), &bridgeInterface{nlh: nh}, t)
+func TestProgramIPTable(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
 
-	// Store various iptables chain rules we care for.
-	rules := []struct {
-		rule  iptRule
-		descr string
-	}{
-		{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-d", "127.1.2.3", "-i", "lo", "-o", "lo", "-j", "DROP"}}, "Test Loopback"},
-		{iptRule{ipv: iptables.IPv4, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", iptablesTestBridgeIP, "!", "-o", DefaultBridgeName, "-j", "MASQUERADE"}}, "NAT Test"},
-		{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-o", DefaultBridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}}, "Test ACCEPT INCOMING"},
-		{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "!", "-o", DefaultBridgeName, "-j", "ACCEPT"}}, "Test ACCEPT NON_ICC OUTGOING"},
-		{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "-o", DefaultBridgeName, "-j", "ACCEPT"}}, "Test enable ICC"},
-		{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "-o", DefaultBridgeName, "-j", "DROP"}}, "Test disable ICC"},
-	}
+			// Create a test bridge with a basic bridge configuration (name + IPv4).
+			defer netnsutils.SetupTestOSContext(t)()
 
-	// Assert the chain rules' insertion and removal.
-	for _, c := range rules {
-		assertIPTableChainProgramming(c.rule, c.descr, t)
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			createTestBridge(getBasicTestConfig(), &bridgeInterface{nlh: nh}, t)
+
+			if _, _, _, _, _, _, err := setupIPChains(configuration{EnableIPTables: true, FirewallBackend: string(backend)}, iptables.IPv4); err != nil {
+				t.Fatal(err)
+			}
+
+			// Store various iptables chain rules we care for.
+			rules := []struct {
+				rule  iptRule
+				descr string
+			}{
+				{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-d", "127.1.2.3", "-i", "lo", "-o", "lo", "-j", "DROP"}}, "Test Loopback"},
+				{iptRule{ipv: iptables.IPv4, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", iptablesTestBridgeIP, "!", "-o", DefaultBridgeName, "-j", "MASQUERADE"}}, "NAT Test"},
+				{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-o", DefaultBridgeName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}}, "Test ACCEPT INCOMING"},
+				{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "!", "-o", DefaultBridgeName, "-j", "ACCEPT"}}, "Test ACCEPT NON_ICC OUTGOING"},
+				{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "-o", DefaultBridgeName, "-j", "ACCEPT"}}, "Test enable ICC"},
+				{iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-i", DefaultBridgeName, "-o", DefaultBridgeName, "-j", "DROP"}}, "Test disable ICC"},
+			}
+
+			// Assert the chain rules' insertion and removal.
+			for _, c := range rules {
+				assertIPTableChainProgramming(c.rule, c.descr, t)
+			}
+		})
 	}
 }
 
 func TestSetupIPChains(t *testing.T) {
-	// Create a test bridge with a basic bridge configuration (name + IPv4).
-	defer netnsutils.SetupTestOSContext(t)()
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
 
-	nh, err := netlink.NewHandle()
-	if err != nil {
-		t.Fatal(err)
-	}
+			// Create a test bridge with a basic bridge configuration (name + IPv4).
+			defer netnsutils.SetupTestOSContext(t)()
 
-	driverconfig := configuration{
-		EnableIPTables: true,
-	}
-	d := &driver{
-		config: driverconfig,
-	}
-	assertChainConfig(d, t)
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	config := getBasicTestConfig()
-	br := &bridgeInterface{nlh: nh}
-	createTestBridge(config, br, t)
+			driverconfig := configuration{
+				EnableIPTables:  true,
+				FirewallBackend: string(backend),
+			}
+			d := &driver{
+				config: driverconfig,
+			}
+			assertChainConfig(d, t)
 
-	assertBridgeConfig(config, br, d, t)
+			config := getBasicTestConfig()
+			br := &bridgeInterface{nlh: nh}
+			createTestBridge(config, br, t)
 
-	config.EnableIPMasquerade = true
-	assertBridgeConfig(config, br, d, t)
+			assertBridgeConfig(config, br, d, t)
 
-	config.EnableICC = true
-	assertBridgeConfig(config, br, d, t)
+			config.EnableIPMasquerade = true
+			assertBridgeConfig(config, br, d, t)
 
-	config.EnableIPMasquerade = false
-	assertBridgeConfig(config, br, d, t)
+			config.EnableICC = true
+			assertBridgeConfig(config, br, d, t)
+
+			config.EnableIPMasquerade = false
+			assertBridgeConfig(config, br, d, t)
+		})
+	}
 }
 
 func getBasicTestConfig() *networkConfiguration {
@@ -120,20 +154,80 @@ func assertIPTableChainProgramming(rule iptRule, descr string, t *testing.T) {
 	}
 }
 
+// TestExposedChainTopology asserts that FORWARD jumps to each of
+// DOCKER-USER, DOCKER-EXPOSED and DOCKER-ISOLATION-STAGE-1, and that a
+// published port's ACCEPT rule lives in DOCKER-EXPOSED rather than FORWARD
+// itself.
+//
+// It also installs a user DROP for the published container in DOCKER-USER
+// and asserts the rule is present. Only the presence of each rule is
+// checked: neither the order of the FORWARD jumps nor whether the DROP
+// overrides the ACCEPT for real traffic is asserted.
+func TestExposedChainTopology(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
+			defer netnsutils.SetupTestOSContext(t)()
+
+			if _, _, _, _, _, _, err := setupIPChains(configuration{EnableIPTables: true, FirewallBackend: string(backend)}, iptables.IPv4); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, jump := range []string{userChain, exposedChainName, isolationChain1} {
+				rule := iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-j", jump}}
+				if !rule.Exists() {
+					t.Fatalf("expected FORWARD to jump to %s", jump)
+				}
+			}
+
+			// setupIPChains also inserts a "FORWARD -j DOCKER" jump in the
+			// mangle table (for MSS clamp/fwmark rules). The filter table's
+			// own FORWARD chain must not see that jump: under the nftables
+			// backend, a chain keyed on name alone (ignoring table) would
+			// collapse the two FORWARD chains together and this rule would
+			// leak in ahead of DOCKER-USER.
+			mangleLeak := iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-j", DockerChain}}
+			if mangleLeak.Exists() {
+				t.Fatal("expected the mangle table's FORWARD -> DOCKER jump not to leak into the filter table's FORWARD chain")
+			}
+			mangleJump := iptRule{ipv: iptables.IPv4, table: iptables.Mangle, chain: "FORWARD", args: []string{"-j", DockerChain}}
+			if !mangleJump.Exists() {
+				t.Fatal("expected the mangle table's own FORWARD -> DOCKER jump to exist")
+			}
+
+			containerIP := net.ParseIP("192.168.42.2")
+			if err := addExposedPortRule("tcp", containerIP, 80); err != nil {
+				t.Fatalf("addExposedPortRule: %v", err)
+			}
+			defer removeExposedPortRule("tcp", containerIP, 80)
+
+			exposedRule := iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: exposedChainName, args: []string{"-d", containerIP.String(), "-p", "tcp", "--dport", "80", "-j", "ACCEPT"}}
+			if !exposedRule.Exists() {
+				t.Fatal("expected published port ACCEPT rule in DOCKER-EXPOSED")
+			}
+
+			// A user-installed DROP ahead of DOCKER-EXPOSED in the jump order
+			// must override the published-port ACCEPT above.
+			userDrop := iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: userChain, args: []string{"-d", containerIP.String(), "-j", "DROP"}}
+			if err := programChainRule(userDrop, "user DROP", true); err != nil {
+				t.Fatalf("failed to program user DROP rule: %v", err)
+			}
+			defer programChainRule(userDrop, "user DROP", false)
+			if !userDrop.Exists() {
+				t.Fatal("expected user DROP rule to be programmed in DOCKER-USER")
+			}
+		})
+	}
+}
+
 // Assert function which create chains.
 func assertChainConfig(d *driver, t *testing.T) {
-	var err error
-
-	d.natChain, d.filterChain, d.isolationChain1, d.isolationChain2, err = setupIPChains(d.config, iptables.IPv4)
-	if err != nil {
+	fw := &iptablesFirewall{driver: d}
+	if err := fw.SetupChains(d.config); err != nil {
 		t.Fatal(err)
 	}
-	if d.config.EnableIP6Tables {
-		d.natChainV6, d.filterChainV6, d.isolationChain1V6, d.isolationChain2V6, err = setupIPChains(d.config, iptables.IPv6)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
+	d.fw = fw
 }
 
 // Assert function which pushes chains based on bridge config parameters.
@@ -158,7 +252,105 @@ func assertBridgeConfig(config *networkConfiguration, br *bridgeInterface, d *dr
 }
 
 // Regression test for https://github.com/moby/moby/issues/46445
+//
+// HostIPv6 isn't set here: unlike HostIPv4, it's validated against the host's
+// interfaces at setup time (see TestSetupIP6TablesWithHostIPv6 below), and
+// 192.0.2.2-style documentation addresses don't resolve to a real interface
+// in the test netns.
 func TestSetupIP6TablesWithHostIPv4(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
+			defer netnsutils.SetupTestOSContext(t)()
+			d := newDriver()
+			dc := &configuration{
+				EnableIPTables:  true,
+				EnableIP6Tables: true,
+				FirewallBackend: string(backend),
+			}
+			if err := d.configure(map[string]interface{}{netlabel.GenericData: dc}); err != nil {
+				t.Fatal(err)
+			}
+			nc := &networkConfiguration{
+				BridgeName:         DefaultBridgeName,
+				AddressIPv4:        &net.IPNet{IP: net.ParseIP(iptablesTestBridgeIP), Mask: net.CIDRMask(16, 32)},
+				EnableIPMasquerade: true,
+				EnableIPv6:         true,
+				AddressIPv6:        &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+				HostIPv4:           net.ParseIP("192.0.2.2"),
+			}
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			br := &bridgeInterface{nlh: nh}
+			createTestBridge(nc, br, t)
+			assertBridgeConfig(nc, br, d, t)
+
+			v4SNAT := iptRule{ipv: iptables.IPv4, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", nc.AddressIPv4.String(), "!", "-o", DefaultBridgeName, "-j", "SNAT", "--to-source", "192.0.2.2"}}
+			if !v4SNAT.Exists() {
+				t.Fatal("expected IPv4 SNAT --to-source rule for HostIPv4")
+			}
+
+			v6Masq := iptRule{ipv: iptables.IPv6, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", nc.AddressIPv6.String(), "!", "-o", DefaultBridgeName, "-j", "MASQUERADE"}}
+			if !v6Masq.Exists() {
+				t.Fatal("expected plain IPv6 MASQUERADE rule when HostIPv6 is unset")
+			}
+		})
+	}
+}
+
+// TestSetupIP6TablesWithHostIPv6 asserts that, symmetrically with HostIPv4,
+// setting HostIPv6 on a network emits a fixed SNAT --to-source rule instead
+// of a plain MASQUERADE for IPv6 traffic leaving the bridge.
+func TestSetupIP6TablesWithHostIPv6(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
+			defer netnsutils.SetupTestOSContext(t)()
+			d := newDriver()
+			dc := &configuration{
+				EnableIPTables:  true,
+				EnableIP6Tables: true,
+				FirewallBackend: string(backend),
+			}
+			if err := d.configure(map[string]interface{}{netlabel.GenericData: dc}); err != nil {
+				t.Fatal(err)
+			}
+
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hostIPv6 := addDummyGlobalUnicastIPv6(t, nh)
+
+			nc := &networkConfiguration{
+				BridgeName:         DefaultBridgeName,
+				AddressIPv4:        &net.IPNet{IP: net.ParseIP(iptablesTestBridgeIP), Mask: net.CIDRMask(16, 32)},
+				EnableIPMasquerade: true,
+				EnableIPv6:         true,
+				AddressIPv6:        &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+				HostIPv6:           hostIPv6,
+			}
+			br := &bridgeInterface{nlh: nh}
+			createTestBridge(nc, br, t)
+			assertBridgeConfig(nc, br, d, t)
+
+			v6SNAT := iptRule{ipv: iptables.IPv6, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", nc.AddressIPv6.String(), "!", "-o", DefaultBridgeName, "-j", "SNAT", "--to-source", hostIPv6.String()}}
+			if !v6SNAT.Exists() {
+				t.Fatal("expected IPv6 SNAT --to-source rule for HostIPv6")
+			}
+		})
+	}
+}
+
+// TestSetupIP6TablesRejectsInvalidHostIPv6 asserts that setupIP6Tables
+// rejects a HostIPv6 address not assigned to any interface on the host. The
+// check runs after the ICC rules are programmed and before any outbound NAT
+// rule is.
+func TestSetupIP6TablesRejectsInvalidHostIPv6(t *testing.T) {
 	defer netnsutils.SetupTestOSContext(t)()
 	d := newDriver()
 	dc := &configuration{
@@ -168,13 +360,14 @@ func TestSetupIP6TablesWithHostIPv4(t *testing.T) {
 	if err := d.configure(map[string]interface{}{netlabel.GenericData: dc}); err != nil {
 		t.Fatal(err)
 	}
+
 	nc := &networkConfiguration{
 		BridgeName:         DefaultBridgeName,
 		AddressIPv4:        &net.IPNet{IP: net.ParseIP(iptablesTestBridgeIP), Mask: net.CIDRMask(16, 32)},
 		EnableIPMasquerade: true,
 		EnableIPv6:         true,
 		AddressIPv6:        &net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
-		HostIPv4:           net.ParseIP("192.0.2.2"),
+		HostIPv6:           net.ParseIP("2001:db8::dead:beef"),
 	}
 	nh, err := netlink.NewHandle()
 	if err != nil {
@@ -182,5 +375,83 @@ func TestSetupIP6TablesWithHostIPv4(t *testing.T) {
 	}
 	br := &bridgeInterface{nlh: nh}
 	createTestBridge(nc, br, t)
-	assertBridgeConfig(nc, br, d, t)
+
+	nw := bridgeNetwork{config: nc, driver: d}
+	if err := nw.setupIP6Tables(nc, br); err == nil {
+		t.Fatal("expected setupIP6Tables to reject a HostIPv6 not assigned to any interface")
+	}
+}
+
+// TestSNATPerEndpoint asserts that addEndpointSNATRule installs a
+// per-endpoint rule keyed on a container's own address, alongside (not
+// instead of) the subnet-wide outbound rule setupOutboundSNAT installs.
+func TestSNATPerEndpoint(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
+			defer netnsutils.SetupTestOSContext(t)()
+			d := newDriver()
+			dc := &configuration{EnableIPTables: true, FirewallBackend: string(backend)}
+			if err := d.configure(map[string]interface{}{netlabel.GenericData: dc}); err != nil {
+				t.Fatal(err)
+			}
+
+			nc := &networkConfiguration{
+				BridgeName:         DefaultBridgeName,
+				AddressIPv4:        &net.IPNet{IP: net.ParseIP(iptablesTestBridgeIP), Mask: net.CIDRMask(16, 32)},
+				EnableIPMasquerade: true,
+				SNATPerEndpoint:    true,
+				HostIPv4:           net.ParseIP("192.0.2.2"),
+			}
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			br := &bridgeInterface{nlh: nh}
+			createTestBridge(nc, br, t)
+			assertBridgeConfig(nc, br, d, t)
+
+			subnetRule := iptRule{ipv: iptables.IPv4, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", nc.AddressIPv4.String(), "!", "-o", DefaultBridgeName, "-j", "SNAT", "--to-source", "192.0.2.2"}}
+			if !subnetRule.Exists() {
+				t.Fatal("expected the subnet-wide SNAT rule to still be installed alongside per-endpoint rules")
+			}
+
+			containerIP := net.ParseIP("192.168.42.2")
+			if err := addEndpointSNATRule(iptables.IPv4, nc, containerIP, nc.HostIPv4); err != nil {
+				t.Fatalf("addEndpointSNATRule: %v", err)
+			}
+			defer removeEndpointSNATRule(iptables.IPv4, nc, containerIP, nc.HostIPv4)
+
+			endpointRule := iptRule{ipv: iptables.IPv4, table: iptables.Nat, chain: "POSTROUTING", args: []string{"-s", containerIP.String(), "!", "-o", DefaultBridgeName, "-j", "SNAT", "--to-source", "192.0.2.2"}}
+			if !endpointRule.Exists() {
+				t.Fatal("expected per-endpoint SNAT rule for the container's address")
+			}
+		})
+	}
+}
+
+// addDummyGlobalUnicastIPv6 creates a dummy link (distinct from the bridge)
+// in the current (test) network namespace and assigns it a global-unicast
+// IPv6 address, so that validateHostIP has a non-bridge interface to find
+// HostIPv6 on.
+func addDummyGlobalUnicastIPv6(t *testing.T, nh *netlink.Handle) net.IP {
+	t.Helper()
+
+	la := netlink.NewLinkAttrs()
+	la.Name = "snat6-dummy0"
+	dummy := &netlink.Dummy{LinkAttrs: la}
+	if err := nh.LinkAdd(dummy); err != nil {
+		t.Fatalf("failed to create dummy link: %v", err)
+	}
+	if err := nh.LinkSetUp(dummy); err != nil {
+		t.Fatalf("failed to bring up dummy link: %v", err)
+	}
+
+	ip := net.ParseIP("2001:db8::2")
+	addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}}
+	if err := nh.AddrAdd(dummy, addr); err != nil {
+		t.Fatalf("failed to assign address to dummy link: %v", err)
+	}
+	return ip
 }
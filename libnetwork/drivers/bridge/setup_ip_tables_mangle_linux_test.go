@@ -0,0 +1,83 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/docker/internal/testutils/netnsutils"
+	"github.com/docker/docker/libnetwork/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+// TestMangleRules asserts that the MSS-clamp and fwmark rules driven by
+// networkConfiguration.MSSClamp/FirewallMark appear in the mangle-table
+// DOCKER chain on network creation and disappear on removal.
+func TestMangleRules(t *testing.T) {
+	for _, backend := range testFirewallBackends {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			skipIfBackendUnavailable(t, backend)
+			defer netnsutils.SetupTestOSContext(t)()
+
+			nh, err := netlink.NewHandle()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			config := getBasicTestConfig()
+			config.MSSClamp = MSSClampAuto
+			config.FirewallMark = 0x42
+			br := &bridgeInterface{nlh: nh}
+			createTestBridge(config, br, t)
+
+			d := &driver{config: configuration{EnableIPTables: true, FirewallBackend: string(backend)}}
+			assertChainConfig(d, t)
+
+			nw := &bridgeNetwork{config: config, driver: d}
+			if err := nw.setupIP4Tables(config, br); err != nil {
+				t.Fatalf("setupIP4Tables: %v", err)
+			}
+
+			mssRule := iptRule{
+				ipv:   iptables.IPv4,
+				table: iptables.Mangle,
+				chain: DockerChain,
+				args:  []string{"-o", DefaultBridgeName, "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"},
+			}
+			if !mssRule.Exists() {
+				t.Fatal("expected MSS clamp rule in the mangle DOCKER chain")
+			}
+
+			markRule := iptRule{
+				ipv:   iptables.IPv4,
+				table: iptables.Mangle,
+				chain: DockerChain,
+				args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", DefaultBridgeName, "-j", "MARK", "--set-mark", "66"},
+			}
+			if !markRule.Exists() {
+				t.Fatal("expected fwmark rule in the mangle DOCKER chain")
+			}
+
+			if err := nw.teardownIP4Tables(config); err != nil {
+				t.Fatalf("teardownIP4Tables: %v", err)
+			}
+			if mssRule.Exists() {
+				t.Fatal("expected MSS clamp rule to be removed from the mangle DOCKER chain")
+			}
+			if markRule.Exists() {
+				t.Fatal("expected fwmark rule to be removed from the mangle DOCKER chain")
+			}
+		})
+	}
+}
+
+func TestMangleRulesInvalidMSSClamp(t *testing.T) {
+	config := &networkConfiguration{
+		BridgeName:  DefaultBridgeName,
+		AddressIPv4: &net.IPNet{IP: net.ParseIP(iptablesTestBridgeIP), Mask: net.CIDRMask(16, 32)},
+		MSSClamp:    "not-a-number",
+	}
+	if err := setupMangleRules(iptables.IPv4, config); err == nil {
+		t.Fatal("expected an error for a non-numeric, non-auto MSSClamp value")
+	}
+}
@@ -0,0 +1,171 @@
+package bridge
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/docker/libnetwork/iptables"
+	"github.com/moby/ipvs"
+	"golang.org/x/sys/unix"
+)
+
+// ipvsFwMark is the fwmark IPVS uses to classify outbound traffic from a
+// bridge network so it can be source-NATed by a single FWMARK service,
+// instead of one masquerade rule per destination.
+const ipvsFwMark = 0x4f5242 // "ORB" -- arbitrary, distinct from fwmarks used elsewhere in the daemon.
+
+// setupIPVSMasquerade programs outbound SNAT for the bridge subnet. An IPVS
+// FWMARK service classifies leaving traffic by marking it in the mangle
+// table, but a FWMARK service has nothing to forward marked packets to
+// without a real server behind it, so it can't do the masquerading itself;
+// the actual NAT is a single MASQUERADE rule scoped only to the bridge's
+// own subnet, narrow enough not to collide with a user's own nat-table
+// rules. Like setupOutboundSNAT, it excludes traffic leaving back out the
+// same bridge, so containers on the same network still see each other's
+// real source IP instead of the host's.
+func (n *bridgeNetwork) setupIPVSMasquerade(config *networkConfiguration) error {
+	h, err := ipvs.New("")
+	if err != nil {
+		return fmt.Errorf("failed to open IPVS handle: %w", err)
+	}
+	defer h.Close()
+
+	svc := &ipvs.Service{
+		AddressFamily: unix.AF_INET,
+		FWMark:        ipvsFwMark,
+		SchedName:     ipvs.RoundRobin,
+	}
+	if err := h.NewService(svc); err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed to create IPVS FWMARK service: %w", err)
+	}
+
+	markRule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Mangle,
+		chain: "POSTROUTING",
+		args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", config.BridgeName, "-j", "MARK", "--set-mark", fmt.Sprintf("%#x", ipvsFwMark)},
+	}
+	if err := programChainRule(markRule, "IPVS masquerade mark", true); err != nil {
+		return err
+	}
+
+	masqRule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Nat,
+		chain: "POSTROUTING",
+		args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", config.BridgeName, "-j", "MASQUERADE"},
+	}
+	return programChainRule(masqRule, "IPVS outbound MASQUERADE", true)
+}
+
+// teardownIPVSMasquerade is the inverse of setupIPVSMasquerade, called when
+// a network that used the IPVS NAT backend is deleted.
+func (n *bridgeNetwork) teardownIPVSMasquerade(config *networkConfiguration) error {
+	masqRule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Nat,
+		chain: "POSTROUTING",
+		args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", config.BridgeName, "-j", "MASQUERADE"},
+	}
+	if err := programChainRule(masqRule, "IPVS outbound MASQUERADE", false); err != nil {
+		return err
+	}
+
+	markRule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Mangle,
+		chain: "POSTROUTING",
+		args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", config.BridgeName, "-j", "MARK", "--set-mark", fmt.Sprintf("%#x", ipvsFwMark)},
+	}
+	if err := programChainRule(markRule, "IPVS masquerade mark", false); err != nil {
+		return err
+	}
+
+	h, err := ipvs.New("")
+	if err != nil {
+		return fmt.Errorf("failed to open IPVS handle: %w", err)
+	}
+	defer h.Close()
+	svc := &ipvs.Service{AddressFamily: unix.AF_INET, FWMark: ipvsFwMark}
+	if err := h.DelService(svc); err != nil && err != unix.ESRCH {
+		return fmt.Errorf("failed to remove IPVS FWMARK service: %w", err)
+	}
+	return nil
+}
+
+// addPortMappingIPVS publishes a single host port by creating (or reusing)
+// an IPVS service for hostIP:hostPort/proto and adding the container as a
+// real server behind it, using masquerade forwarding. A loopback hostIP is
+// rejected with an error, since IPVS services bound to 127.0.0.0/8 aren't
+// reachable the way iptables DNAT rules are; nothing in this driver
+// publishes such a port through the iptables backend instead.
+func (n *bridgeNetwork) addPortMappingIPVS(proto ipvs.Protocol, hostIP net.IP, hostPort int, containerIP net.IP, containerPort int) error {
+	if hostIP.IsLoopback() {
+		return fmt.Errorf("IPVS NAT backend cannot publish on loopback address %s", hostIP)
+	}
+
+	h, err := ipvs.New("")
+	if err != nil {
+		return fmt.Errorf("failed to open IPVS handle: %w", err)
+	}
+	defer h.Close()
+
+	svc := &ipvs.Service{
+		AddressFamily: unix.AF_INET,
+		Protocol:      uint16(proto),
+		Address:       hostIP,
+		Port:          uint16(hostPort),
+		SchedName:     ipvs.RoundRobin,
+	}
+	if err := h.NewService(svc); err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed to create IPVS service for %s:%d: %w", hostIP, hostPort, err)
+	}
+
+	dst := &ipvs.Destination{
+		AddressFamily:   unix.AF_INET,
+		Address:         containerIP,
+		Port:            uint16(containerPort),
+		Weight:          1,
+		ConnectionFlags: ipvs.ConnFwdMasq,
+	}
+	if err := h.NewDestination(svc, dst); err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed to add IPVS destination %s:%d: %w", containerIP, containerPort, err)
+	}
+
+	return nil
+}
+
+// removePortMappingIPVS removes the real server added by addPortMappingIPVS
+// and, if it was the last one, the service itself.
+func (n *bridgeNetwork) removePortMappingIPVS(proto ipvs.Protocol, hostIP net.IP, hostPort int, containerIP net.IP, containerPort int) error {
+	h, err := ipvs.New("")
+	if err != nil {
+		return fmt.Errorf("failed to open IPVS handle: %w", err)
+	}
+	defer h.Close()
+
+	svc := &ipvs.Service{
+		AddressFamily: unix.AF_INET,
+		Protocol:      uint16(proto),
+		Address:       hostIP,
+		Port:          uint16(hostPort),
+		SchedName:     ipvs.RoundRobin,
+	}
+	dst := &ipvs.Destination{
+		AddressFamily: unix.AF_INET,
+		Address:       containerIP,
+		Port:          uint16(containerPort),
+	}
+	if err := h.DelDestination(svc, dst); err != nil {
+		return fmt.Errorf("failed to remove IPVS destination %s:%d: %w", containerIP, containerPort, err)
+	}
+
+	dests, err := h.Destinations(svc)
+	if err == nil && len(dests) == 0 {
+		if err := h.DelService(svc); err != nil {
+			return fmt.Errorf("failed to remove IPVS service for %s:%d: %w", hostIP, hostPort, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/docker/docker/internal/testutils/netnsutils"
+	"github.com/docker/docker/libnetwork/iptables"
+	"github.com/docker/docker/libnetwork/portmapper"
+	"github.com/moby/ipvs"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// TestProgramIPVSNAT is the IPVS-backend analogue of TestProgramIPTable: it
+// asserts that published ports and outbound masquerading show up as IPVS
+// services/destinations on network creation and disappear on removal, and
+// that a published port's IPVS service and destination are still programmed
+// with a user-added FORWARD REJECT rule in place. No traffic is sent, so
+// container connectivity itself is not checked.
+func TestProgramIPVSNAT(t *testing.T) {
+	defer netnsutils.SetupTestOSContext(t)()
+
+	nh, err := netlink.NewHandle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := getBasicTestConfig()
+	config.EnableIPMasquerade = true
+	br := &bridgeInterface{nlh: nh}
+	createTestBridge(config, br, t)
+
+	d := &driver{config: configuration{EnableIPTables: true, NATBackend: NATBackendIPVS}}
+	nw := &bridgeNetwork{config: config, driver: d, portMapper: portmapper.New(), portMapperV6: portmapper.New()}
+
+	if err := nw.setupIP4Tables(config, br); err != nil {
+		t.Fatalf("setupIP4Tables with IPVS backend: %v", err)
+	}
+
+	h, err := ipvs.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	if !hasFWMarkService(t, h, ipvsFwMark) {
+		t.Fatal("expected an IPVS FWMARK service after setupIP4Tables")
+	}
+
+	// The outbound MASQUERADE rule must exclude traffic leaving back out the
+	// bridge, the same way setupOutboundSNAT's does, so that containers on
+	// the same network still see each other's real source IP.
+	masqRule := iptRule{
+		ipv:   iptables.IPv4,
+		table: iptables.Nat,
+		chain: "POSTROUTING",
+		args:  []string{"-s", config.AddressIPv4.String(), "!", "-o", config.BridgeName, "-j", "MASQUERADE"},
+	}
+	if !masqRule.Exists() {
+		t.Fatal("expected the IPVS outbound MASQUERADE rule to exclude intra-bridge traffic")
+	}
+
+	// A user-installed REJECT rule ahead of any Docker chain must not
+	// interfere with the IPVS-programmed service.
+	userReject := iptRule{ipv: iptables.IPv4, table: iptables.Filter, chain: "FORWARD", args: []string{"-j", "REJECT"}}
+	if err := programChainRule(userReject, "user REJECT", true); err != nil {
+		t.Fatalf("failed to program user REJECT rule: %v", err)
+	}
+	defer programChainRule(userReject, "user REJECT", false)
+
+	containerIP := net.ParseIP("192.168.42.2")
+	hostIP := net.ParseIP("192.0.2.1")
+	if err := nw.addPortMappingIPVS(ipvs.Protocol(unix.IPPROTO_TCP), hostIP, 8080, containerIP, 80); err != nil {
+		t.Fatalf("addPortMappingIPVS: %v", err)
+	}
+
+	svc := &ipvs.Service{AddressFamily: unix.AF_INET, Protocol: uint16(unix.IPPROTO_TCP), Address: hostIP, Port: 8080}
+	if !hasService(t, h, svc) {
+		t.Fatal("expected an IPVS service for the published port after addPortMappingIPVS")
+	}
+	if !hasDestination(t, h, svc, containerIP, 80) {
+		t.Fatal("expected an IPVS destination for the container after addPortMappingIPVS")
+	}
+
+	if err := nw.removePortMappingIPVS(ipvs.Protocol(unix.IPPROTO_TCP), hostIP, 8080, containerIP, 80); err != nil {
+		t.Fatalf("removePortMappingIPVS: %v", err)
+	}
+
+	if hasService(t, h, svc) {
+		t.Fatal("expected the IPVS service to be gone after removePortMappingIPVS removed its last destination")
+	}
+
+	if err := nw.teardownIPVSMasquerade(config); err != nil {
+		t.Fatalf("teardownIPVSMasquerade: %v", err)
+	}
+
+	if hasFWMarkService(t, h, ipvsFwMark) {
+		t.Fatal("expected the IPVS FWMARK service to be gone after teardownIPVSMasquerade")
+	}
+}
+
+// hasFWMarkService reports whether an IPVS FWMARK service with the given
+// mark is currently programmed.
+func hasFWMarkService(t *testing.T, h *ipvs.Handle, fwMark int) bool {
+	t.Helper()
+	svcs, err := h.Services()
+	if err != nil {
+		t.Fatalf("IPVS Services: %v", err)
+	}
+	for _, s := range svcs {
+		if s.FWMark == uint32(fwMark) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasService reports whether an IPVS service matching want's address family,
+// protocol, address and port is currently programmed.
+func hasService(t *testing.T, h *ipvs.Handle, want *ipvs.Service) bool {
+	t.Helper()
+	svcs, err := h.Services()
+	if err != nil {
+		t.Fatalf("IPVS Services: %v", err)
+	}
+	for _, s := range svcs {
+		if s.AddressFamily == want.AddressFamily && s.Protocol == want.Protocol &&
+			s.Address.Equal(want.Address) && s.Port == want.Port {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDestination reports whether svc currently has a destination at
+// destIP:destPort.
+func hasDestination(t *testing.T, h *ipvs.Handle, svc *ipvs.Service, destIP net.IP, destPort int) bool {
+	t.Helper()
+	dests, err := h.Destinations(svc)
+	if err != nil {
+		t.Fatalf("IPVS Destinations: %v", err)
+	}
+	for _, d := range dests {
+		if d.Address.Equal(destIP) && d.Port == uint16(destPort) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestAddPortMappingIPVSRejectsLoopback asserts that addPortMappingIPVS
+// rejects a loopback host address and creates no IPVS service for it, since
+// an IPVS service bound to 127.0.0.0/8 isn't reachable the way an iptables
+// DNAT rule is.
+func TestAddPortMappingIPVSRejectsLoopback(t *testing.T) {
+	defer netnsutils.SetupTestOSContext(t)()
+
+	nw := &bridgeNetwork{}
+	hostIP := net.ParseIP("127.0.0.1")
+	err := nw.addPortMappingIPVS(ipvs.Protocol(unix.IPPROTO_TCP), hostIP, 8080, net.ParseIP("192.168.42.2"), 80)
+	if err == nil {
+		t.Fatal("expected addPortMappingIPVS to reject a loopback host address")
+	}
+
+	h, err := ipvs.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	svc := &ipvs.Service{AddressFamily: unix.AF_INET, Protocol: uint16(unix.IPPROTO_TCP), Address: hostIP, Port: 8080}
+	if hasService(t, h, svc) {
+		t.Fatal("expected no IPVS service to have been created for a rejected loopback address")
+	}
+}
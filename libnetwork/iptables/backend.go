@@ -0,0 +1,79 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// FirewallBackend abstracts the operations the bridge driver needs from the
+// host firewall, so that callers don't have to know whether rules end up as
+// legacy iptables, iptables-nft, or native nftables.
+type FirewallBackend interface {
+	// NewChain creates (or adopts, if it already exists) a chain in the
+	// given table and returns a handle to it.
+	NewChain(name string, table Table) (*ChainInfo, error)
+	// RemoveExistingChain removes a chain previously created with NewChain.
+	RemoveExistingChain(name string, table Table) error
+	// AddRule inserts a rule at the head of chain.
+	AddRule(table Table, chain string, args ...string) error
+	// RemoveRule removes a previously added rule from chain.
+	RemoveRule(table Table, chain string, args ...string) error
+	// Exists reports whether a rule is currently present in chain.
+	Exists(table Table, chain string, args ...string) bool
+}
+
+// BackendName identifies one of the supported FirewallBackend
+// implementations.
+type BackendName string
+
+const (
+	// BackendIPTables programs rules with the legacy/iptables-nft
+	// iptables(8) binary, via the existing IPTable type.
+	BackendIPTables BackendName = "iptables"
+	// BackendNFTables programs rules directly against the nftables
+	// subsystem, in a dedicated "docker" table.
+	BackendNFTables BackendName = "nftables"
+	// BackendAuto selects BackendNFTables when the host's iptables
+	// binary is iptables-nft (or an nftables "docker" table already
+	// exists), and BackendIPTables otherwise.
+	BackendAuto BackendName = "auto"
+)
+
+// SelectFirewallBackend resolves name (as set by the daemon's
+// --firewall-backend flag) to a concrete FirewallBackend, detecting the
+// host's setup when name is BackendAuto or empty.
+func SelectFirewallBackend(name BackendName, version IPVersion) (FirewallBackend, error) {
+	switch name {
+	case BackendIPTables:
+		return newIPTablesBackend(version), nil
+	case BackendNFTables:
+		return newNFTablesBackend(version)
+	case BackendAuto, "":
+		if detectNFTablesPreferred() {
+			if be, err := newNFTablesBackend(version); err == nil {
+				return be, nil
+			}
+		}
+		return newIPTablesBackend(version), nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q: must be one of %q, %q, %q", name, BackendIPTables, BackendNFTables, BackendAuto)
+	}
+}
+
+// detectNFTablesPreferred reports whether the host's iptables(8) is the
+// iptables-nft variant (in which case rules already live in the nftables
+// subsystem, so using it natively avoids two tools fighting over one
+// ruleset) or whether an nftables "docker" table already exists from a
+// previous run with the nftables backend selected.
+func detectNFTablesPreferred() bool {
+	if out, err := exec.Command("iptables", "--version").CombinedOutput(); err == nil {
+		if bytes.Contains(out, []byte("nf_tables")) {
+			return true
+		}
+	}
+	if err := exec.Command("nft", "list", "table", "ip", "docker").Run(); err == nil {
+		return true
+	}
+	return false
+}
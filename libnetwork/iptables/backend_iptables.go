@@ -0,0 +1,31 @@
+package iptables
+
+// iptablesBackend implements FirewallBackend on top of the existing
+// IPTable type, which shells out to the iptables(8)/ip6tables(8) binaries.
+type iptablesBackend struct {
+	iptable *IPTable
+}
+
+func newIPTablesBackend(version IPVersion) FirewallBackend {
+	return &iptablesBackend{iptable: GetIptable(version)}
+}
+
+func (b *iptablesBackend) NewChain(name string, table Table) (*ChainInfo, error) {
+	return b.iptable.NewChain(name, table)
+}
+
+func (b *iptablesBackend) RemoveExistingChain(name string, table Table) error {
+	return b.iptable.RemoveExistingChain(name, table)
+}
+
+func (b *iptablesBackend) AddRule(table Table, chain string, args ...string) error {
+	return b.iptable.ProgramRule(table, chain, Insert, args)
+}
+
+func (b *iptablesBackend) RemoveRule(table Table, chain string, args ...string) error {
+	return b.iptable.ProgramRule(table, chain, Delete, args)
+}
+
+func (b *iptablesBackend) Exists(table Table, chain string, args ...string) bool {
+	return b.iptable.Exists(table, chain, args...)
+}
@@ -0,0 +1,314 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// nftablesBackend implements FirewallBackend by shelling out to nft(8).
+// Rules live in a dedicated "docker" table per address family, so they
+// never interleave with tables a user or another tool manages.
+type nftablesBackend struct {
+	family string // "ip" or "ip6"
+
+	mu         sync.Mutex
+	baseChains map[string]bool // built-in (hook) chains already created, keyed by nftChainName(table, name)
+}
+
+func newNFTablesBackend(version IPVersion) (FirewallBackend, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nftables backend requested but nft(8) not found: %w", err)
+	}
+	family := "ip"
+	if version == IPv6 {
+		family = "ip6"
+	}
+	b := &nftablesBackend{family: family, baseChains: map[string]bool{}}
+	if err := b.run(fmt.Sprintf("add table %s docker", family)); err != nil {
+		return nil, fmt.Errorf("failed to create nftables docker table: %w", err)
+	}
+	return b, nil
+}
+
+func (b *nftablesBackend) run(stmts ...string) error {
+	script := strings.Join(stmts, "\n") + "\n"
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (b *nftablesBackend) NewChain(name string, table Table) (*ChainInfo, error) {
+	nftName := nftChainName(table, name)
+	nftChainType, hook, priority := nftHookFor(table, name)
+	stmt := fmt.Sprintf("add chain %s docker %s", b.family, nftName)
+	if nftChainType != "" {
+		stmt = fmt.Sprintf("add chain %s docker %s { type %s hook %s priority %s ; }", b.family, nftName, nftChainType, hook, priority)
+	}
+	if err := b.run(stmt); err != nil {
+		return nil, fmt.Errorf("failed to create nftables chain %s: %w", nftName, err)
+	}
+	if nftChainType != "" {
+		b.mu.Lock()
+		b.baseChains[nftName] = true
+		b.mu.Unlock()
+	}
+	return &ChainInfo{Name: name, Table: table}, nil
+}
+
+func (b *nftablesBackend) RemoveExistingChain(name string, table Table) error {
+	nftName := nftChainName(table, name)
+	if err := b.run(fmt.Sprintf("flush chain %s docker %s", b.family, nftName)); err != nil {
+		return err
+	}
+	return b.run(fmt.Sprintf("delete chain %s docker %s", b.family, nftName))
+}
+
+func (b *nftablesBackend) AddRule(table Table, chain string, args ...string) error {
+	if err := b.ensureBaseChain(table, chain); err != nil {
+		return err
+	}
+	expr, err := translateToNFT(table, args)
+	if err != nil {
+		return fmt.Errorf("nftables backend: %w", err)
+	}
+	return b.run(fmt.Sprintf("insert rule %s docker %s %s", b.family, nftChainName(table, chain), expr))
+}
+
+func (b *nftablesBackend) RemoveRule(table Table, chain string, args ...string) error {
+	// nft has no direct "delete by match" primitive, so the rule's handle is
+	// looked up in the chain's listing first and the rule is deleted by
+	// handle. An error is returned when no listed rule matches.
+	expr, err := translateToNFT(table, args)
+	if err != nil {
+		return fmt.Errorf("nftables backend: %w", err)
+	}
+	handle, err := b.findRuleHandle(table, chain, expr)
+	if err != nil {
+		return err
+	}
+	return b.run(fmt.Sprintf("delete rule %s docker %s handle %s", b.family, nftChainName(table, chain), handle))
+}
+
+func (b *nftablesBackend) Exists(table Table, chain string, args ...string) bool {
+	expr, err := translateToNFT(table, args)
+	if err != nil {
+		return false
+	}
+	out, err := exec.Command("nft", "-a", "list", "chain", b.family, "docker", nftChainName(table, chain)).CombinedOutput()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), expr)
+}
+
+func (b *nftablesBackend) findRuleHandle(table Table, chain, expr string) (string, error) {
+	nftName := nftChainName(table, chain)
+	out, err := exec.Command("nft", "-a", "list", "chain", b.family, "docker", nftName).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to list chain %s: %w", nftName, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, expr) {
+			continue
+		}
+		idx := strings.LastIndex(line, "# handle ")
+		if idx == -1 {
+			continue
+		}
+		return strings.TrimSpace(line[idx+len("# handle "):]), nil
+	}
+	return "", fmt.Errorf("rule not found in chain %s", nftName)
+}
+
+// ensureBaseChain creates the netfilter base chain backing one of the
+// built-in chains the driver inserts rules into directly -- FORWARD,
+// PREROUTING, POSTROUTING, in either the filter/nat/mangle table -- the
+// first time a rule targets it. Docker's own chains (DOCKER, DOCKER-USER,
+// ...) are created up front by NewChain and reached only by a jump from one
+// of these, so nftHookFor returns empty values for them and this is a
+// no-op.
+func (b *nftablesBackend) ensureBaseChain(table Table, chain string) error {
+	nftChainType, hook, priority := nftHookFor(table, chain)
+	if nftChainType == "" {
+		return nil
+	}
+	nftName := nftChainName(table, chain)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.baseChains[nftName] {
+		return nil
+	}
+	stmt := fmt.Sprintf("add chain %s docker %s { type %s hook %s priority %s ; }", b.family, nftName, nftChainType, hook, priority)
+	if err := b.run(stmt); err != nil {
+		return fmt.Errorf("failed to create nftables base chain %s: %w", nftName, err)
+	}
+	b.baseChains[nftName] = true
+	return nil
+}
+
+// nftChainName derives the nft chain name backing an iptables-style
+// (table, name) pair. The docker nft table has no notion of separate
+// filter/nat/mangle tables the way iptables does, so FORWARD in the filter
+// table and FORWARD in the mangle table (or POSTROUTING in nat vs. mangle)
+// would otherwise collide onto the same physical nft chain; qualifying the
+// name with its table keeps them distinct, matching iptables' own
+// per-table isolation.
+func nftChainName(table Table, name string) string {
+	return fmt.Sprintf("%s_%s", table, name)
+}
+
+// nftHookFor reports the nftables base-chain type/hook/priority for the
+// small set of (table, built-in chain) pairs the bridge driver attaches to
+// directly; Docker's own chains (DOCKER, DOCKER-ISOLATION-STAGE-*, ...) are
+// plain non-base chains reached by a jump from one of these, so they return
+// empty values. Mangle hooks use the filter chain type at the conventional
+// NF_IP_PRI_MANGLE priority (-150), same as iptables' own mangle table
+// ordering relative to nat (-100/100) and filter (0).
+func nftHookFor(table Table, name string) (chainType, hook, priority string) {
+	switch {
+	case table == Nat && name == "PREROUTING":
+		return "nat", "prerouting", "-100"
+	case table == Nat && name == "POSTROUTING":
+		return "nat", "postrouting", "100"
+	case table == Filter && name == "FORWARD":
+		return "filter", "forward", "0"
+	case table == Mangle && name == "PREROUTING":
+		return "filter", "prerouting", "-150"
+	case table == Mangle && name == "FORWARD":
+		return "filter", "forward", "-150"
+	case table == Mangle && name == "POSTROUTING":
+		return "filter", "postrouting", "-150"
+	default:
+		return "", "", ""
+	}
+}
+
+// translateToNFT converts the subset of iptables-style -flag arg pairs the
+// bridge driver emits into an nftables rule expression. Unsupported flags
+// return an error rather than silently dropping a match.
+func translateToNFT(table Table, args []string) (string, error) {
+	var b strings.Builder
+	var proto string // set by the last -p seen, used to qualify --dport
+	neg := false
+	// writeMatch emits "field value" for a positive match, or
+	// "field != value" the one time it follows a "!" token.
+	writeMatch := func(field, val string) {
+		if neg {
+			fmt.Fprintf(&b, "%s != %s ", field, val)
+			neg = false
+			return
+		}
+		fmt.Fprintf(&b, "%s %s ", field, val)
+	}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "-d":
+			field := "saddr"
+			if args[i] == "-d" {
+				field = "daddr"
+			}
+			i++
+			l3 := "ip"
+			if strings.Contains(args[i], ":") {
+				l3 = "ip6"
+			}
+			writeMatch(l3+" "+field, args[i])
+		case "-i":
+			i++
+			writeMatch("iifname", fmt.Sprintf("%q", args[i]))
+		case "-o":
+			i++
+			writeMatch("oifname", fmt.Sprintf("%q", args[i]))
+		case "-p":
+			i++
+			proto = strings.ToLower(args[i])
+			writeMatch("ip protocol", proto)
+		case "--dport":
+			i++
+			field := "th"
+			if proto == "tcp" || proto == "udp" {
+				field = proto
+			}
+			writeMatch(field+" dport", args[i])
+		case "--tcp-flags":
+			mask, comp := args[i+1], args[i+2]
+			i += 2
+			fmt.Fprintf(&b, "tcp flags & (%s) == %s ", nftFlagList(mask), nftFlagList(comp))
+		case "--set-mss":
+			i++
+			fmt.Fprintf(&b, "tcp option maxseg size set %s ", args[i])
+		case "--clamp-mss-to-pmtu":
+			b.WriteString("tcp option maxseg size set rt mtu ")
+		case "--set-mark":
+			i++
+			fmt.Fprintf(&b, "meta mark set %s ", args[i])
+		case "--to-source":
+			i++
+			fmt.Fprintf(&b, "to %s ", args[i])
+		case "!":
+			neg = true
+		case "-j":
+			i++
+			switch verb := args[i]; verb {
+			case "TCPMSS", "MARK":
+				// These targets carry no statement of their own; the
+				// option that follows (--clamp-mss-to-pmtu/--set-mss,
+				// --set-mark) supplies the actual nft statement.
+			case "ACCEPT", "DROP", "REJECT", "MASQUERADE", "RETURN", "SNAT":
+				fmt.Fprintf(&b, "%s ", nftVerb(verb))
+			default:
+				// Any other target is one of Docker's own chains, in the
+				// same table as the rule jumping to it.
+				fmt.Fprintf(&b, "jump %s ", nftChainName(table, verb))
+			}
+		case "-m":
+			// Match-module name (e.g. conntrack); the option that follows
+			// supplies the actual match.
+			i++
+		case "--ctstate":
+			i++
+			writeMatch("ct state", strings.ToLower(args[i]))
+		default:
+			return "", fmt.Errorf("unsupported iptables argument %q for nftables translation", args[i])
+		}
+	}
+	if neg {
+		return "", fmt.Errorf("dangling negation operator in iptables arguments")
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// nftFlagList converts a comma-separated iptables TCP flag list (e.g.
+// "SYN,RST") into the nft flag-set syntax (e.g. "syn | rst").
+func nftFlagList(flags string) string {
+	parts := strings.Split(flags, ",")
+	for i, p := range parts {
+		parts[i] = strings.ToLower(p)
+	}
+	return strings.Join(parts, " | ")
+}
+
+func nftVerb(action string) string {
+	switch action {
+	case "ACCEPT":
+		return "accept"
+	case "DROP":
+		return "drop"
+	case "REJECT":
+		return "reject"
+	case "MASQUERADE":
+		return "masquerade"
+	case "RETURN":
+		return "return"
+	default:
+		return strings.ToLower(action)
+	}
+}